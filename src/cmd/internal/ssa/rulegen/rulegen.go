@@ -17,8 +17,11 @@ import (
 	"fmt"
 	"go/format"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"regexp"
 	"sort"
 	"strings"
 )
@@ -33,10 +36,17 @@ import (
 //         | <type>
 //         | {code}
 //
-// aux      ::= variable | {code}
-// type     ::= variable | {code}
-// variable ::= some token
+// aux      ::= variable | {code} | pred
+// type     ::= variable | {code} | pred
+// pred     ::= variable ":" predicate
+// variable ::= some token, or "_" for don't-care
 // opcode   ::= one of the opcodes from ../op.go (without the Op prefix)
+//
+// "_" matches anything and binds nothing.  A pred like <t:is64BitInt>
+// or [c:isPowerOfTwo] binds the variable (to v.Type or v.AuxInt,
+// respectively, unless the variable is itself "_") and additionally
+// requires that the named Go function, called on that value, returns
+// true.
 
 // extra conditions is just a chunk of Go that evaluates to a boolean.  It may use
 // variables declared in the matching sexpr.  The variable "v" is predefined to be
@@ -44,7 +54,42 @@ import (
 
 // If multiple rules match, the first one in file order is selected.
 
+// commutativeOps is the set of opcodes for which swapping the two
+// value arguments doesn't change the meaning of the op.  For any
+// rule whose top opcode is in this set, and whose two value
+// arguments differ, rulegen also generates the rule with the
+// arguments swapped, so the .rules file doesn't have to spell out
+// both orderings by hand.
+//
+// The set can be extended per rule file by a leading
+// "// commutative Op1 Op2 ..." comment line, or by an adjacent
+// commutative.txt sidecar file listing one opcode per line.
+var commutativeOps = map[string]bool{
+	"Add": true,
+	"Mul": true,
+	"And": true,
+	"Or":  true,
+	"Xor": true,
+	"Eq":  true,
+	"Neq": true,
+}
+
 func main() {
+	if len(os.Args) >= 2 && os.Args[1] == "-verify" {
+		if len(os.Args) < 3 || len(os.Args) > 4 {
+			fmt.Printf("usage: go run rulegen.go -verify <rule file> [<op file>]")
+			os.Exit(1)
+		}
+		var opfile string
+		if len(os.Args) == 4 {
+			opfile = os.Args[3]
+		}
+		if verify(os.Args[2], opfile) {
+			os.Exit(1)
+		}
+		return
+	}
+
 	if len(os.Args) < 3 || len(os.Args) > 4 {
 		fmt.Printf("usage: go run rulegen.go <rule file> <function name> [<output file>]")
 		os.Exit(1)
@@ -52,11 +97,46 @@ func main() {
 	rulefile := os.Args[1]
 	rulefn := os.Args[2]
 
+	b, err := generateRules(rulefile, rulefn, strings.Join(os.Args[1:], " "))
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	// Write to a file if given, otherwise stdout.
+	var out io.WriteCloser
+	if len(os.Args) >= 4 {
+		outfile := os.Args[3]
+		out, err = os.Create(outfile)
+		if err != nil {
+			log.Fatalf("can't open output file %s: %v\n", outfile, err)
+		}
+	} else {
+		out = os.Stdout
+	}
+	if _, err = out.Write(b); err != nil {
+		log.Fatalf("can't write output: %v\n", err)
+	}
+	if err = out.Close(); err != nil {
+		log.Fatalf("can't close output: %v\n", err)
+	}
+}
+
+// generateRules reads rulefile and returns the gofmt'd source of the
+// rulefn rewrite function it describes, the same bytes main() writes
+// to its output file. invocation is recorded verbatim in the
+// "generated with" header comment, matching the command line main()
+// was given.
+func generateRules(rulefile, rulefn, invocation string) ([]byte, error) {
 	// Open input file.
 	text, err := os.Open(rulefile)
 	if err != nil {
-		log.Fatalf("can't read rule file: %v", err)
+		return nil, fmt.Errorf("can't read rule file: %v", err)
 	}
+	defer text.Close()
+
+	// pick up any commutative.txt sidecar or inline "// commutative ..."
+	// directive before expanding rules below.
+	commutativeOps = loadCommutativeOps(rulefile)
 
 	// oprules contains a list of rules for each opcode
 	oprules := map[string][]string{}
@@ -75,16 +155,18 @@ func main() {
 			continue
 		}
 		op := strings.Split(line, " ")[0][1:]
-		oprules[op] = append(oprules[op], line)
+		for _, rule := range expandCommutative(line) {
+			oprules[op] = append(oprules[op], rule)
+		}
 	}
 	if err := scanner.Err(); err != nil {
-		log.Fatalf("scanner failed: %v\n", err)
+		return nil, fmt.Errorf("scanner failed: %v", err)
 	}
 
 	// Start output buffer, write header.
 	w := new(bytes.Buffer)
 	fmt.Fprintf(w, "// autogenerated from %s: do not edit!\n", rulefile)
-	fmt.Fprintf(w, "// generated with: go run rulegen/rulegen.go %s\n", strings.Join(os.Args[1:], " "))
+	fmt.Fprintf(w, "// generated with: go run rulegen/rulegen.go %s\n", invocation)
 	fmt.Fprintln(w, "package ssa")
 	fmt.Fprintf(w, "func %s(v *Value) bool {\n", rulefn)
 
@@ -98,86 +180,302 @@ func main() {
 	rulenum := 0
 	for _, op := range ops {
 		fmt.Fprintf(w, "case Op%s:\n", op)
-		for _, rule := range oprules[op] {
-			// split at ->
-			s := strings.Split(rule, "->")
-			if len(s) != 2 {
-				log.Fatalf("no arrow in rule %s", rule)
-			}
-			lhs := strings.Trim(s[0], " \t")
-			result := strings.Trim(s[1], " \t\n")
-
-			// split match into matching part and additional condition
-			match := lhs
-			cond := ""
-			if i := strings.Index(match, "&&"); i >= 0 {
-				cond = strings.Trim(match[i+2:], " \t")
-				match = strings.Trim(match[:i], " \t")
-			}
+		emitRules(w, oprules[op], &rulenum, nil)
+	}
+	fmt.Fprintf(w, "}\n")
+	fmt.Fprintf(w, "return false\n")
+	fmt.Fprintf(w, "}\n")
+
+	// gofmt result
+	return format.Source(w.Bytes())
+}
+
+// expandCommutative returns rule, plus one additional copy of rule
+// for every distinct way its LHS can be rewritten by swapping the
+// arguments of commutative opcodes (see commutativeOps).  cond and
+// result are left untouched, since they refer to the same bound
+// variables regardless of argument order.
+func expandCommutative(rule string) []string {
+	arrow := strings.Index(rule, "->")
+	if arrow < 0 {
+		log.Fatalf("no arrow in rule %s", rule)
+	}
+	lhs := strings.TrimSpace(rule[:arrow])
+	rest := strings.TrimSpace(rule[arrow+2:])
 
-			fmt.Fprintf(w, "// match: %s\n", match)
-			fmt.Fprintf(w, "// cond: %s\n", cond)
-			fmt.Fprintf(w, "// result: %s\n", result)
+	match := lhs
+	cond := ""
+	if i := strings.Index(match, "&&"); i >= 0 {
+		cond = strings.TrimSpace(match[i+2:])
+		match = strings.TrimSpace(match[:i])
+	}
+
+	variants := commutativeVariants(match)
+	rules := make([]string, len(variants))
+	for i, v := range variants {
+		if cond != "" {
+			rules[i] = fmt.Sprintf("%s && %s -> %s", v, cond, rest)
+		} else {
+			rules[i] = fmt.Sprintf("%s -> %s", v, rest)
+		}
+	}
+	return rules
+}
+
+// commutativeVariants returns all the syntactically distinct sexprs
+// equivalent to expr once commutative opcodes are free to swap their
+// two value arguments.  Nested commutative subexprs are expanded
+// recursively; the result is deduped and always contains at least
+// expr itself.
+func commutativeVariants(expr string) []string {
+	if expr == "" || expr[0] != '(' {
+		return []string{expr}
+	}
+	s := split(expr[1 : len(expr)-1])
+	op := s[0]
+
+	var valueArgs []int
+	argVariants := make([][]string, len(s)-1)
+	for i, a := range s[1:] {
+		if a[0] == '<' || a[0] == '[' || a[0] == '{' {
+			argVariants[i] = []string{a}
+			continue
+		}
+		valueArgs = append(valueArgs, i)
+		argVariants[i] = commutativeVariants(a)
+	}
 
-			fail := fmt.Sprintf("{\ngoto end%d\n}\n", rulenum)
+	seen := map[string]bool{}
+	var out []string
+	add := func(args []string) {
+		e := "(" + op + " " + strings.Join(args, " ") + ")"
+		if !seen[e] {
+			seen[e] = true
+			out = append(out, e)
+		}
+	}
+	var build func(i int, cur []string)
+	build = func(i int, cur []string) {
+		if i == len(argVariants) {
+			add(cur)
+			if commutativeOps[op] && len(valueArgs) == 2 {
+				swapped := append([]string{}, cur...)
+				a, b := valueArgs[0], valueArgs[1]
+				swapped[a], swapped[b] = swapped[b], swapped[a]
+				add(swapped)
+			}
+			return
+		}
+		for _, v := range argVariants[i] {
+			next := append(append([]string{}, cur...), v)
+			build(i+1, next)
+		}
+	}
+	build(0, nil)
+	return out
+}
+
+// emitRules emits, into w, a decision tree that applies rules (all of
+// which already apply to the value matched by the enclosing "case
+// OpX:") and advances *rulenum for every leaf it emits. Consecutive
+// rules whose top match requires a concrete opcode at the same
+// argument index are merged into a single "switch v_N.Op { ... }"
+// node instead of each re-deriving and re-checking v.Args[N]
+// independently; hoist records, for argument indices already proven
+// and bound by an enclosing node, the variable holding that value so
+// nested matches don't recheck or re-derive it. Only a conflict-free
+// prefix of rules is ever merged, which preserves first-match-wins
+// semantics: leaves are emitted grouped by opcode bucket, but within a
+// bucket they keep their original order, so the rules that can match a
+// given value are still tried in original rule order.
+func emitRules(w io.Writer, rules []string, rulenum *int, hoist map[int]string) {
+	for len(rules) > 0 {
+		argIdx, runLen := bestDiscriminator(rules, hoist)
+		if runLen < 2 {
+			emitRule(w, rules[0], rulenum, hoist)
+			rules = rules[1:]
+			continue
+		}
+		run := rules[:runLen]
+		rules = rules[runLen:]
 
-			fmt.Fprintf(w, "{\n")
-			genMatch(w, match, fail)
+		hv := fmt.Sprintf("v_%d", argIdx)
+		fmt.Fprintf(w, "%s := v.Args[%d]\n", hv, argIdx)
+		fmt.Fprintf(w, "switch %s.Op {\n", hv)
 
-			if cond != "" {
-				fmt.Fprintf(w, "if !(%s) %s", cond, fail)
+		var order []string
+		buckets := map[string][]string{}
+		for _, rule := range run {
+			op := argOp(rule, argIdx)
+			if _, ok := buckets[op]; !ok {
+				order = append(order, op)
 			}
+			buckets[op] = append(buckets[op], rule)
+		}
 
-			genResult(w, result)
-			fmt.Fprintf(w, "return true\n")
+		next := map[int]string{argIdx: hv}
+		for k, v := range hoist {
+			next[k] = v
+		}
+		for _, op := range order {
+			fmt.Fprintf(w, "case Op%s:\n", op)
+			emitRules(w, buckets[op], rulenum, next)
+		}
+		fmt.Fprintf(w, "}\n")
+	}
+}
 
-			fmt.Fprintf(w, "}\n")
-			fmt.Fprintf(w, "end%d:;\n", rulenum)
-			rulenum++
+// bestDiscriminator picks the argument index, among those not already
+// hoisted, for which the longest prefix of rules all require a
+// concrete opcode. It returns argIdx == -1 if no index yields a
+// mergeable run of 2 or more rules.
+func bestDiscriminator(rules []string, hoist map[int]string) (argIdx, runLen int) {
+	argIdx, runLen = -1, 1
+	for idx := range topArgs(matchPart(rules[0])) {
+		if _, ok := hoist[idx]; ok {
+			continue
+		}
+		run := 0
+		for _, rule := range rules {
+			args := topArgs(matchPart(rule))
+			if idx >= len(args) || args[idx][0] != '(' {
+				break
+			}
+			run++
+		}
+		if run > runLen {
+			argIdx, runLen = idx, run
 		}
 	}
-	fmt.Fprintf(w, "}\n")
-	fmt.Fprintf(w, "return false\n")
-	fmt.Fprintf(w, "}\n")
+	return argIdx, runLen
+}
 
-	// gofmt result
-	b := w.Bytes()
-	b, err = format.Source(b)
-	if err != nil {
-		panic(err)
+// matchPart strips the "-> result" and "&& cond" suffixes from rule,
+// leaving just the LHS sexpr.
+func matchPart(rule string) string {
+	lhs := strings.TrimSpace(rule[:strings.Index(rule, "->")])
+	if i := strings.Index(lhs, "&&"); i >= 0 {
+		lhs = strings.TrimSpace(lhs[:i])
 	}
+	return lhs
+}
 
-	// Write to a file if given, otherwise stdout.
-	var out io.WriteCloser
-	if len(os.Args) >= 4 {
-		outfile := os.Args[3]
-		out, err = os.Create(outfile)
-		if err != nil {
-			log.Fatalf("can't open output file %s: %v\n", outfile, err)
+// topArgs returns the argument tokens of match's top-level sexpr
+// (skipping <type> and [aux] restrictions), in v.Args order.
+func topArgs(match string) []string {
+	if match == "" || match[0] != '(' {
+		return nil
+	}
+	s := split(match[1 : len(match)-1])
+	var args []string
+	for _, a := range s[1:] {
+		if a[0] == '<' || a[0] == '[' {
+			continue
 		}
-	} else {
-		out = os.Stdout
+		args = append(args, a)
 	}
-	if _, err = out.Write(b); err != nil {
-		log.Fatalf("can't write output: %v\n", err)
+	return args
+}
+
+// argOp returns the opcode (without the Op prefix) of rule's top-level
+// argument at argIdx. The caller must only call this when that
+// argument is known to be a sexpr.
+func argOp(rule string, argIdx int) string {
+	a := topArgs(matchPart(rule))[argIdx]
+	return split(a[1 : len(a)-1])[0]
+}
+
+// emitRule emits the match/cond/result for a single rule as one
+// "{ ... }; endN:;" block and advances *rulenum. hoist carries
+// argument indices already bound and opcode-checked by an enclosing
+// emitRules node, so genMatch doesn't redo that work.
+func emitRule(w io.Writer, rule string, rulenum *int, hoist map[int]string) {
+	// split at ->
+	s := strings.Split(rule, "->")
+	if len(s) != 2 {
+		log.Fatalf("no arrow in rule %s", rule)
 	}
-	if err = out.Close(); err != nil {
-		log.Fatalf("can't close output: %v\n", err)
+	lhs := strings.Trim(s[0], " \t")
+	result := strings.Trim(s[1], " \t\n")
+
+	// split match into matching part and additional condition
+	match := lhs
+	cond := ""
+	if i := strings.Index(match, "&&"); i >= 0 {
+		cond = strings.Trim(match[i+2:], " \t")
+		match = strings.Trim(match[:i], " \t")
+	}
+
+	fmt.Fprintf(w, "// match: %s\n", match)
+	fmt.Fprintf(w, "// cond: %s\n", cond)
+	fmt.Fprintf(w, "// result: %s\n", result)
+
+	n := *rulenum
+	fail := fmt.Sprintf("{\ngoto end%d\n}\n", n)
+
+	fmt.Fprintf(w, "{\n")
+	m, used := genMatch(w, match, fail, hoist)
+
+	if cond != "" {
+		fmt.Fprintf(w, "if !(%s) %s", cond, fail)
+		used = true
+	}
+
+	genResult(w, result, auxIntVars(m))
+	fmt.Fprintf(w, "return true\n")
+
+	fmt.Fprintf(w, "}\n")
+	// end%d is only referenced by the gotos genMatch/cond actually
+	// emitted above. A rule an enclosing decision tree fully
+	// discriminates (see emitRules' hoist) and that adds no further
+	// restriction of its own emits none, so the label must be skipped
+	// too, or the generated file fails to build with "label end%d
+	// defined and not used".
+	if used {
+		fmt.Fprintf(w, "end%d:;\n", n)
 	}
+	*rulenum++
+}
+
+// genMatch emits the match code for match and returns the variable ->
+// bound-expression map it built (e.g. "c" -> "v_0.AuxInt"), so the
+// caller can tell genResult which names were bound as AuxInt rather
+// than Aux, along with whether it ever emitted a reference to fail
+// (see emitRule).
+func genMatch(w io.Writer, match, fail string, hoist map[int]string) (map[string]string, bool) {
+	m := map[string]string{}
+	used := false
+	genMatch0(w, match, "v", fail, m, true, hoist, &used)
+	return m, used
 }
 
-func genMatch(w io.Writer, match, fail string) {
-	genMatch0(w, match, "v", fail, map[string]string{}, true)
+// auxIntVars returns the set of names in m (as built by genMatch) that
+// were bound to a value's AuxInt field, e.g. via a [c:isPowerOfTwo]
+// match. genResult0 uses this to decide whether a RHS [...] token that
+// mentions one of these names should set AuxInt instead of Aux.
+func auxIntVars(m map[string]string) map[string]bool {
+	vars := map[string]bool{}
+	for name, expr := range m {
+		if strings.HasSuffix(expr, ".AuxInt") {
+			vars[name] = true
+		}
+	}
+	return vars
 }
 
-func genMatch0(w io.Writer, match, v, fail string, m map[string]string, top bool) {
+func genMatch0(w io.Writer, match, v, fail string, m map[string]string, top bool, hoist map[int]string, used *bool) {
 	if match[0] != '(' {
+		if match == "_" {
+			// don't-care: no check, no binding
+			return
+		}
 		if x, ok := m[match]; ok {
 			// variable already has a definition.  Check whether
 			// the old definition and the new definition match.
 			// For example, (add x x).  Equality is just pointer equality
 			// on Values (so cse is important to do before lowering).
 			fmt.Fprintf(w, "if %s != %s %s", v, x, fail)
+			*used = true
 			return
 		}
 		// remember that this variable references the given value
@@ -193,6 +491,7 @@ func genMatch0(w io.Writer, match, v, fail string, m map[string]string, top bool
 	// check op
 	if !top {
 		fmt.Fprintf(w, "if %s.Op != Op%s %s", v, s[0], fail)
+		*used = true
 	}
 
 	// check type/aux/args
@@ -201,14 +500,34 @@ func genMatch0(w io.Writer, match, v, fail string, m map[string]string, top bool
 		if a[0] == '<' {
 			// type restriction
 			t := a[1 : len(a)-1]
-			if t[0] == '{' {
+			if t == "_" {
+				// wildcard: no check
+			} else if t[0] == '{' {
 				// code.  We must match the results of this code.
 				fmt.Fprintf(w, "if %s.Type != %s %s", v, t[1:len(t)-1], fail)
+				*used = true
+			} else if i := strings.Index(t, ":"); i >= 0 {
+				// name:pred, e.g. <t:is64BitInt>.  Binds name to v.Type
+				// (unless name is "_") and additionally requires
+				// pred(v.Type).
+				name, pred := t[:i], t[i+1:]
+				if name == "_" {
+					fmt.Fprintf(w, "if !%s(%s.Type) %s", pred, v, fail)
+				} else if u, ok := m[name]; ok {
+					fmt.Fprintf(w, "if %s.Type != %s %s", v, u, fail)
+					fmt.Fprintf(w, "if !%s(%s) %s", pred, u, fail)
+				} else {
+					m[name] = v + ".Type"
+					fmt.Fprintf(w, "%s := %s.Type\n", name, v)
+					fmt.Fprintf(w, "if !%s(%s) %s", pred, name, fail)
+				}
+				*used = true
 			} else {
 				// variable
 				if u, ok := m[t]; ok {
 					// must match previous variable
 					fmt.Fprintf(w, "if %s.Type != %s %s", v, u, fail)
+					*used = true
 				} else {
 					m[t] = v + ".Type"
 					fmt.Fprintf(w, "%s := %s.Type\n", t, v)
@@ -217,13 +536,33 @@ func genMatch0(w io.Writer, match, v, fail string, m map[string]string, top bool
 		} else if a[0] == '[' {
 			// aux restriction
 			x := a[1 : len(a)-1]
-			if x[0] == '{' {
+			if x == "_" {
+				// wildcard: no check
+			} else if x[0] == '{' {
 				// code
 				fmt.Fprintf(w, "if %s.Aux != %s %s", v, x[1:len(x)-1], fail)
+				*used = true
+			} else if i := strings.Index(x, ":"); i >= 0 {
+				// name:pred, e.g. [c:isPowerOfTwo].  Binds name to
+				// v.AuxInt (unless name is "_") and additionally
+				// requires pred(v.AuxInt).
+				name, pred := x[:i], x[i+1:]
+				if name == "_" {
+					fmt.Fprintf(w, "if !%s(%s.AuxInt) %s", pred, v, fail)
+				} else if y, ok := m[name]; ok {
+					fmt.Fprintf(w, "if %s.AuxInt != %s %s", v, y, fail)
+					fmt.Fprintf(w, "if !%s(%s) %s", pred, y, fail)
+				} else {
+					m[name] = v + ".AuxInt"
+					fmt.Fprintf(w, "%s := %s.AuxInt\n", name, v)
+					fmt.Fprintf(w, "if !%s(%s) %s", pred, name, fail)
+				}
+				*used = true
 			} else {
 				// variable
 				if y, ok := m[x]; ok {
 					fmt.Fprintf(w, "if %s.Aux != %s %s", v, y, fail)
+					*used = true
 				} else {
 					m[x] = v + ".Aux"
 					fmt.Fprintf(w, "%s := %s.Aux\n", x, v)
@@ -231,19 +570,36 @@ func genMatch0(w io.Writer, match, v, fail string, m map[string]string, top bool
 			}
 		} else if a[0] == '{' {
 			fmt.Fprintf(w, "if %s.Args[%d] != %s %s", v, argnum, a[1:len(a)-1], fail)
+			*used = true
 			argnum++
 		} else {
-			// variable or sexpr
-			genMatch0(w, a, fmt.Sprintf("%s.Args[%d]", v, argnum), fail, m, false)
+			// variable or sexpr.  If an enclosing node already proved
+			// and bound this argument (hoist), reuse its binding and
+			// skip the opcode recheck instead of rederiving v.Args[N].
+			argv := fmt.Sprintf("%s.Args[%d]", v, argnum)
+			argtop := false
+			if top {
+				if hv, ok := hoist[argnum]; ok {
+					argv, argtop = hv, true
+				}
+			}
+			genMatch0(w, a, argv, fail, m, argtop, nil, used)
 			argnum++
 		}
 	}
 }
 
-func genResult(w io.Writer, result string) {
-	genResult0(w, result, new(int), true)
+func genResult(w io.Writer, result string, auxIntVars map[string]bool) {
+	genResult0(w, result, new(int), true, auxIntVars)
 }
-func genResult0(w io.Writer, result string, alloc *int, top bool) string {
+
+// genResult0 emits the construction of result and returns the name of
+// the Value it builds. auxIntVars is the set of match-bound names that
+// hold a matched value's AuxInt (as opposed to its Aux); a RHS [...]
+// token is written to AuxInt instead of Aux whenever it mentions one of
+// them, so a rule like (Mul <t:is64BitInt> x [c:isPowerOfTwo]) -> (Lsh
+// x [log2(c)]) stores the shift count in the right field.
+func genResult0(w io.Writer, result string, alloc *int, top bool, auxIntVars map[string]bool) string {
 	if result[0] != '(' {
 		// variable
 		return result
@@ -278,12 +634,19 @@ func genResult0(w io.Writer, result string, alloc *int, top bool) string {
 			if x[0] == '{' {
 				x = x[1 : len(x)-1]
 			}
-			fmt.Fprintf(w, "%s.Aux = %s\n", v, x)
+			field := "Aux"
+			for _, id := range identRe.FindAllString(x, -1) {
+				if auxIntVars[id] {
+					field = "AuxInt"
+					break
+				}
+			}
+			fmt.Fprintf(w, "%s.%s = %s\n", v, field, x)
 		} else if a[0] == '{' {
 			fmt.Fprintf(w, "%s.AddArg(%s)\n", v, a[1:len(a)-1])
 		} else {
 			// regular argument (sexpr or variable)
-			x := genResult0(w, a, alloc, false)
+			x := genResult0(w, a, alloc, false, auxIntVars)
 			fmt.Fprintf(w, "%s.AddArg(%s)\n", v, x)
 		}
 	}
@@ -325,4 +688,648 @@ outer:
 		break
 	}
 	return r
-}
\ No newline at end of file
+}
+
+// ruleInfo is a parsed rule together with its source line, for
+// reporting by verify.
+type ruleInfo struct {
+	line int
+	text string
+}
+
+// goBuiltins is the set of lowercase tokens that may legitimately
+// appear in a cond without being bound on the LHS: Go predeclared
+// identifiers that checkUnboundVars would otherwise mistake for
+// pattern variables.
+var goBuiltins = map[string]bool{
+	"true": true, "false": true, "nil": true, "iota": true,
+	"int": true, "int8": true, "int16": true, "int32": true, "int64": true,
+	"uint": true, "uint8": true, "uint16": true, "uint32": true, "uint64": true,
+	"byte": true, "rune": true, "string": true, "bool": true,
+	"float32": true, "float64": true, "uintptr": true,
+}
+
+var identRe = regexp.MustCompile(`[A-Za-z_][A-Za-z0-9_]*`)
+var opTokenRe = regexp.MustCompile(`\bOp([A-Z][A-Za-z0-9_]*)\b`)
+
+// verify implements "-verify <rule file> [<op file>]": it parses the
+// rule file and statically reports, without generating any code,
+// rules that can never fire (dead rules subsumed by an earlier one),
+// rules whose RHS trivially reproduces the LHS's shape (likely
+// non-terminating), variables used on the RHS or in a cond but never
+// bound on the LHS, and aux/type variables reused with inconsistent
+// roles. The dead-rule and non-termination checks run against the
+// commutative-expanded rule set (the same one codegen actually
+// switches on, see expandCommutative), since a rule that only becomes
+// dead or non-terminating after its argument-swapped variant is
+// generated is just as real a bug; problems are still reported against
+// the original source line. If opfile is non-empty, it additionally
+// flags opcodes the rules reference that opfile doesn't define. It
+// prints one "file:line: message" line per problem and reports whether
+// it found any.
+func verify(rulefile, opfile string) bool {
+	oprules, err := parseRuleFile(rulefile)
+	if err != nil {
+		log.Fatalf("can't read rule file: %v", err)
+	}
+
+	// expandCommutative reads the package-level commutativeOps, so swap
+	// in rulefile's merged set only for the extent of this call; verify
+	// may be called more than once in the same process (tests, or a
+	// future caller that lints several rule files in one run).
+	savedOps := commutativeOps
+	commutativeOps = loadCommutativeOps(rulefile)
+	defer func() { commutativeOps = savedOps }()
+	expanded, err := parseRuleFileExpanded(rulefile)
+	if err != nil {
+		log.Fatalf("can't read rule file: %v", err)
+	}
+
+	var ops []string
+	for op := range oprules {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+
+	var problems []string
+	for _, op := range ops {
+		rules := oprules[op]
+		problems = append(problems, checkDeadRules(rulefile, expanded[op])...)
+		problems = append(problems, checkNonTerminating(rulefile, op, expanded[op])...)
+		for _, r := range rules {
+			problems = append(problems, checkUnboundVars(rulefile, r)...)
+			problems = append(problems, checkRoleConflicts(rulefile, r)...)
+		}
+	}
+	problems = dedupStrings(problems)
+
+	if opfile != "" {
+		known, err := parseOpcodes(opfile)
+		if err != nil {
+			log.Fatalf("can't read op file: %v", err)
+		}
+		problems = append(problems, checkUnknownOpcodes(rulefile, opfile, oprules, known)...)
+	} else {
+		log.Printf("no op file given; skipping the unknown-opcode check")
+	}
+
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if len(problems) == 0 {
+		fmt.Printf("%s: no problems found\n", rulefile)
+		return false
+	}
+	fmt.Printf("%s: %d problem(s) found\n", rulefile, len(problems))
+	return true
+}
+
+// parseRuleFile reads rulefile the same way generateRules does, but keeps each
+// rule's source line number and doesn't expand commutative variants,
+// since verify reports against what the user actually wrote.
+func parseRuleFile(rulefile string) (map[string][]ruleInfo, error) {
+	f, err := os.Open(rulefile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	oprules := map[string][]ruleInfo{}
+	scanner := bufio.NewScanner(f)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := scanner.Text()
+		if i := strings.Index(line, "//"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		op := strings.Split(line, " ")[0][1:]
+		oprules[op] = append(oprules[op], ruleInfo{lineno, line})
+	}
+	return oprules, scanner.Err()
+}
+
+// loadCommutativeOps returns the set of commutative opcodes in effect
+// for rulefile: the package-level defaults plus any adjacent
+// commutative.txt sidecar and any "// commutative Op1 Op2 ..." directive
+// among rulefile's leading comment lines. Both generateRules and verify call
+// this so codegen and -verify always agree on which ops are
+// commutative.
+func loadCommutativeOps(rulefile string) map[string]bool {
+	ops := map[string]bool{}
+	for op, v := range commutativeOps {
+		ops[op] = v
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(filepath.Dir(rulefile), "commutative.txt")); err == nil {
+		for _, op := range strings.Fields(string(data)) {
+			ops[op] = true
+		}
+	}
+	f, err := os.Open(rulefile)
+	if err != nil {
+		return ops
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "//") {
+			// the leading comment block is over; directives after the
+			// first rule (including in a commented-out example rule)
+			// don't count.
+			break
+		}
+		dir := strings.TrimSpace(line[len("//"):])
+		if !strings.HasPrefix(dir, "commutative ") {
+			continue
+		}
+		for _, op := range strings.Fields(dir[len("commutative "):]) {
+			ops[op] = true
+		}
+	}
+	return ops
+}
+
+// parseRuleFileExpanded reads rulefile like parseRuleFile, but expands
+// each rule's commutative argument-swap variants (see
+// expandCommutative) the same way generateRules does before codegen. Every
+// variant of a rule is recorded against that rule's original source
+// line, so checks that run against the expanded set can still report
+// file:line locations the user recognizes.
+func parseRuleFileExpanded(rulefile string) (map[string][]ruleInfo, error) {
+	f, err := os.Open(rulefile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	oprules := map[string][]ruleInfo{}
+	scanner := bufio.NewScanner(f)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := scanner.Text()
+		if i := strings.Index(line, "//"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		op := strings.Split(line, " ")[0][1:]
+		for _, variant := range expandCommutative(line) {
+			oprules[op] = append(oprules[op], ruleInfo{lineno, variant})
+		}
+	}
+	return oprules, scanner.Err()
+}
+
+// dedupStrings returns problems with exact duplicates removed,
+// preserving order of first occurrence. Expanding rules into multiple
+// commutative variants can make the same problem get reported more
+// than once (e.g. both argument orders of a dead rule are subsumed by
+// the same earlier rule).
+func dedupStrings(problems []string) []string {
+	seen := map[string]bool{}
+	var out []string
+	for _, p := range problems {
+		if seen[p] {
+			continue
+		}
+		seen[p] = true
+		out = append(out, p)
+	}
+	return out
+}
+
+// splitMatchCond splits a rule into its LHS match sexpr and its cond
+// (empty if the rule has no "&&").
+func splitMatchCond(rule string) (match, cond string) {
+	lhs := strings.TrimSpace(rule[:strings.Index(rule, "->")])
+	match = lhs
+	if i := strings.Index(lhs, "&&"); i >= 0 {
+		cond = strings.TrimSpace(lhs[i+2:])
+		match = strings.TrimSpace(lhs[:i])
+	}
+	return match, cond
+}
+
+// resultPart returns the RHS sexpr of a rule.
+func resultPart(rule string) string {
+	return strings.TrimSpace(rule[strings.Index(rule, "->")+2:])
+}
+
+// filterArgs drops the <type> and [aux] tokens from a split top-level
+// arg list, leaving only the value-arg tokens in v.Args order.
+func filterArgs(args []string) []string {
+	var out []string
+	for _, a := range args {
+		if a[0] == '<' || a[0] == '[' {
+			continue
+		}
+		out = append(out, a)
+	}
+	return out
+}
+
+// checkDeadRules reports rules that can never fire because an earlier,
+// unconditional rule's LHS already matches everything theirs does.
+func checkDeadRules(rulefile string, rules []ruleInfo) []string {
+	var problems []string
+	for i, a := range rules {
+		aMatch, aCond := splitMatchCond(a.text)
+		if aCond != "" {
+			// a doesn't always fire on values matching its LHS, so it
+			// can't be shown to make a later rule unreachable.
+			continue
+		}
+		for _, b := range rules[i+1:] {
+			if b.line == a.line {
+				// a and b are commutative-swap variants of the very
+				// same source rule; a variant subsuming its own sibling
+				// isn't the cross-rule shadowing this check looks for.
+				continue
+			}
+			bMatch, _ := splitMatchCond(b.text)
+			if subsumes(aMatch, bMatch) {
+				problems = append(problems, fmt.Sprintf("%s:%d: rule is unreachable; already matched by the rule at line %d", rulefile, b.line, a.line))
+			}
+		}
+	}
+	return problems
+}
+
+// subsumes reports whether every value matching sexpr b is guaranteed
+// to also match sexpr a. It's conservative: it returns false whenever
+// it can't prove subsumption, including whenever a binds the same
+// variable name twice (an equality constraint this simple check
+// doesn't attempt to track).
+func subsumes(a, b string) bool {
+	if a == "_" {
+		return true
+	}
+	if a[0] != '(' {
+		return true // a is a fresh variable, matches anything
+	}
+	if hasRepeatedVars(a) {
+		return false
+	}
+	if b == "" || b[0] != '(' {
+		return false
+	}
+	sa, sb := split(a[1:len(a)-1]), split(b[1:len(b)-1])
+	if sa[0] != sb[0] || len(sa) != len(sb) {
+		return false
+	}
+	for i := 1; i < len(sa); i++ {
+		ai, bi := sa[i], sb[i]
+		if isRestriction(ai) || isRestriction(bi) {
+			if ai != bi {
+				return false
+			}
+			continue
+		}
+		if !subsumes(ai, bi) {
+			return false
+		}
+	}
+	return true
+}
+
+func isRestriction(tok string) bool {
+	return tok[0] == '<' || tok[0] == '[' || tok[0] == '{'
+}
+
+// hasRepeatedVars reports whether expr binds the same plain variable
+// name (other than "_") more than once.
+func hasRepeatedVars(expr string) bool {
+	seen := map[string]bool{}
+	dup := false
+	var walk func(e string)
+	walk = func(e string) {
+		if dup || e == "" || e == "_" {
+			return
+		}
+		if e[0] != '(' {
+			if seen[e] {
+				dup = true
+			}
+			seen[e] = true
+			return
+		}
+		for _, a := range split(e[1 : len(e)-1])[1:] {
+			if !isRestriction(a) {
+				walk(a)
+			}
+		}
+	}
+	walk(expr)
+	return dup
+}
+
+// checkNonTerminating reports rules whose RHS rewrites v to the exact
+// same outer opcode and value-argument shape as the LHS, an obvious
+// sign the rule will just re-match itself forever. A cond doesn't save
+// a rule from this: if the cond holds once, the rewrite leaves the
+// matched node's shape untouched, so the same cond holds again on the
+// very same node. This also catches commutative-swap variants (see
+// parseRuleFileExpanded) whose RHS expandCommutative left unswapped,
+// which can turn an otherwise-fine rule into exactly this shape.
+func checkNonTerminating(rulefile, op string, rules []ruleInfo) []string {
+	var problems []string
+	for _, r := range rules {
+		match, _ := splitMatchCond(r.text)
+		result := resultPart(r.text)
+		if result == "" || result[0] != '(' {
+			continue
+		}
+		rs := split(result[1 : len(result)-1])
+		if rs[0] != op {
+			continue
+		}
+		if sameTokens(topArgs(match), filterArgs(rs[1:])) {
+			problems = append(problems, fmt.Sprintf("%s:%d: rule rewrites Op%s to the same Op%s shape; it may never terminate", rulefile, r.line, op, op))
+		}
+	}
+	return problems
+}
+
+func sameTokens(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// boundVars returns the set of plain variable names match binds,
+// whether as a value argument, a <type> or [aux] variable, or the
+// name half of a <name:pred> or [name:pred].
+func boundVars(match string) map[string]bool {
+	bound := map[string]bool{}
+	var walk func(e string)
+	walk = func(e string) {
+		if e == "" || e == "_" {
+			return
+		}
+		if e[0] != '(' {
+			bound[e] = true
+			return
+		}
+		for _, a := range split(e[1 : len(e)-1])[1:] {
+			switch {
+			case a[0] == '<' || a[0] == '[':
+				if name := restrictionName(a); name != "" {
+					bound[name] = true
+				}
+			case a[0] == '{':
+				// code: nothing to bind
+			default:
+				walk(a)
+			}
+		}
+	}
+	walk(match)
+	return bound
+}
+
+// restrictionName returns the bound variable name of a <...> or [...]
+// token ("" if it's code or the wildcard "_").
+func restrictionName(tok string) string {
+	inner := tok[1 : len(tok)-1]
+	if inner == "" || inner == "_" || inner[0] == '{' {
+		return ""
+	}
+	if i := strings.Index(inner, ":"); i >= 0 {
+		inner = inner[:i]
+	}
+	if inner == "_" {
+		return ""
+	}
+	return inner
+}
+
+// resultAuxParts classifies the contents of a RHS <...>/[...] token for
+// checkUnboundVars: at most one of the two returns is non-empty, and
+// both are empty for "", "_" and a "_:pred" wildcard. A
+// plain "name" or "name:pred" token returns its name (the part before
+// any ":", mirroring restrictionName; the predicate identifier itself
+// is never checked, same as on the LHS). Anything else — "{code}" or a
+// bare Go expression like log2(c) — returns that code, since genResult0
+// treats both forms as a literal expression to embed as-is.
+func resultAuxParts(inner string) (name, code string) {
+	if inner == "" || inner == "_" {
+		return "", ""
+	}
+	if inner[0] == '{' {
+		return "", inner[1 : len(inner)-1]
+	}
+	if i := strings.Index(inner, ":"); i >= 0 {
+		name = inner[:i]
+		if name == "_" {
+			return "", ""
+		}
+		return name, ""
+	}
+	if identRe.FindString(inner) == inner {
+		return inner, ""
+	}
+	return "", inner
+}
+
+// checkUnboundVars reports variables used in r's result or cond that
+// are never bound anywhere on its LHS.
+func checkUnboundVars(rulefile string, r ruleInfo) []string {
+	var problems []string
+	match, cond := splitMatchCond(r.text)
+	bound := boundVars(match)
+	bound["v"] = true // v is predefined as the value matched by the whole rule
+
+	var walk func(e string)
+	walk = func(e string) {
+		if e == "" || e == "_" {
+			return
+		}
+		if e[0] != '(' {
+			if !bound[e] {
+				problems = append(problems, fmt.Sprintf("%s:%d: result uses %q, which is never bound on the LHS", rulefile, r.line, e))
+			}
+			return
+		}
+		for _, a := range split(e[1 : len(e)-1])[1:] {
+			switch {
+			case a[0] == '<' || a[0] == '[':
+				name, code := resultAuxParts(a[1 : len(a)-1])
+				if code != "" {
+					for _, tok := range unboundCodeIdents(code, bound) {
+						problems = append(problems, fmt.Sprintf("%s:%d: result uses %q, which is never bound on the LHS", rulefile, r.line, tok))
+					}
+				} else if name != "" && !bound[name] {
+					problems = append(problems, fmt.Sprintf("%s:%d: result uses %q, which is never bound on the LHS", rulefile, r.line, name))
+				}
+			case a[0] == '{':
+				for _, tok := range unboundCodeIdents(a[1:len(a)-1], bound) {
+					problems = append(problems, fmt.Sprintf("%s:%d: result uses %q, which is never bound on the LHS", rulefile, r.line, tok))
+				}
+			default:
+				walk(a)
+			}
+		}
+	}
+	if result := resultPart(r.text); result != "" {
+		walk(result)
+	}
+
+	for _, tok := range unboundCodeIdents(cond, bound) {
+		problems = append(problems, fmt.Sprintf("%s:%d: cond uses %q, which is never bound on the LHS", rulefile, r.line, tok))
+	}
+	return problems
+}
+
+// unboundCodeIdents returns the identifiers in code that look like
+// references to unbound pattern variables: lowercase-leading
+// identifiers that aren't a Go builtin, aren't in bound, aren't
+// immediately followed by "(" (which marks a function call, not a
+// variable reference), and aren't part of a dotted selector like
+// "typ.UInt64" or "x.Type". Selectors are skipped entirely rather than
+// checking just the base identifier: there's no way to tell a package
+// reference (typ) from a genuinely unbound one by syntax alone, and
+// false positives on common, valid rules like "<typ.UInt64>" are worse
+// than missing the rare unbound selector.
+func unboundCodeIdents(code string, bound map[string]bool) []string {
+	var out []string
+	for _, m := range identRe.FindAllStringIndex(code, -1) {
+		tok := code[m[0]:m[1]]
+		if tok == "" || tok[0] < 'a' || tok[0] > 'z' {
+			continue
+		}
+		if goBuiltins[tok] || bound[tok] {
+			continue
+		}
+		if strings.HasPrefix(strings.TrimLeft(code[m[1]:], " \t"), "(") {
+			continue
+		}
+		if m[0] > 0 && code[m[0]-1] == '.' {
+			continue
+		}
+		if strings.HasPrefix(code[m[1]:], ".") {
+			continue
+		}
+		out = append(out, tok)
+	}
+	return out
+}
+
+// checkRoleConflicts reports a variable name that's bound to more than
+// one role (value, type, aux, or auxint) within the same rule, e.g.
+// used as both <t> and [t].
+func checkRoleConflicts(rulefile string, r ruleInfo) []string {
+	match, _ := splitMatchCond(r.text)
+	roles := map[string]string{}
+	var problems []string
+	record := func(name, role string) {
+		if name == "" || name == "_" {
+			return
+		}
+		if prev, ok := roles[name]; ok {
+			if prev != role {
+				problems = append(problems, fmt.Sprintf("%s:%d: %q is used as both %s and %s", rulefile, r.line, name, prev, role))
+			}
+			return
+		}
+		roles[name] = role
+	}
+	var walk func(e string)
+	walk = func(e string) {
+		if e == "" || e == "_" {
+			return
+		}
+		if e[0] != '(' {
+			record(e, "value")
+			return
+		}
+		for _, a := range split(e[1 : len(e)-1])[1:] {
+			switch {
+			case a[0] == '<':
+				record(restrictionName(a), "type")
+			case a[0] == '[':
+				role := "aux"
+				if strings.Contains(a, ":") {
+					role = "auxint"
+				}
+				record(restrictionName(a), role)
+			case a[0] == '{':
+				// code: nothing to bind
+			default:
+				walk(a)
+			}
+		}
+	}
+	walk(match)
+	return problems
+}
+
+// parseOpcodes extracts the set of opcodes (without the Op prefix)
+// defined in opfile, by scanning for Op<Name> tokens.
+func parseOpcodes(opfile string) (map[string]bool, error) {
+	data, err := ioutil.ReadFile(opfile)
+	if err != nil {
+		return nil, err
+	}
+	known := map[string]bool{}
+	for _, m := range opTokenRe.FindAllStringSubmatch(string(data), -1) {
+		known[m[1]] = true
+	}
+	return known, nil
+}
+
+// checkUnknownOpcodes reports every opcode referenced anywhere in
+// oprules (as a case, a nested sexpr on the LHS, or the RHS) that
+// isn't in known.
+func checkUnknownOpcodes(rulefile, opfile string, oprules map[string][]ruleInfo, known map[string]bool) []string {
+	var problems []string
+	reported := map[string]bool{}
+	report := func(op string, line int) {
+		key := fmt.Sprintf("%s:%d", op, line)
+		if known[op] || reported[key] {
+			return
+		}
+		reported[key] = true
+		problems = append(problems, fmt.Sprintf("%s:%d: opcode Op%s is not defined in %s", rulefile, line, op, opfile))
+	}
+	for op, rules := range oprules {
+		for _, r := range rules {
+			report(op, r.line)
+			match, _ := splitMatchCond(r.text)
+			walkOps(match, func(o string) { report(o, r.line) })
+			walkOps(resultPart(r.text), func(o string) { report(o, r.line) })
+		}
+	}
+	return problems
+}
+
+// walkOps calls f with the opcode of expr and of every nested sexpr
+// within it.
+func walkOps(expr string, f func(string)) {
+	if expr == "" || expr[0] != '(' {
+		return
+	}
+	s := split(expr[1 : len(expr)-1])
+	f(s[0])
+	for _, a := range s[1:] {
+		if !isRestriction(a) {
+			walkOps(a, f)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestCommutativeVariants(t *testing.T) {
+	cases := []struct {
+		expr string
+		want []string
+	}{
+		{"x", []string{"x"}},
+		{"(Add x y)", []string{"(Add x y)", "(Add y x)"}},
+		{"(Add x x)", []string{"(Add x x)"}},
+		{"(Sub x y)", []string{"(Sub x y)"}},
+		{
+			"(Lsh (Add x y) z)",
+			[]string{"(Lsh (Add x y) z)", "(Lsh (Add y x) z)"},
+		},
+	}
+	for _, c := range cases {
+		got := commutativeVariants(c.expr)
+		sort.Strings(got)
+		want := append([]string{}, c.want...)
+		sort.Strings(want)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("commutativeVariants(%q) = %v, want %v", c.expr, got, want)
+		}
+	}
+}
+
+func TestSubsumes(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want bool
+	}{
+		{"x", "(Add a b)", true},
+		{"_", "(Add a b)", true},
+		{"(Add x y)", "(Add a b)", true},
+		{"(Add x x)", "(Add a b)", false}, // repeated var is an equality constraint
+		{"(Add (Const [1]) y)", "(Add a b)", false},
+		{"(Add (Const [1]) y)", "(Add (Const [1]) b)", true},
+		{"(Add (Const [1]) y)", "(Add (Const [2]) b)", false},
+		{"(Mul a b)", "(Add a b)", false},
+	}
+	for _, c := range cases {
+		if got := subsumes(c.a, c.b); got != c.want {
+			t.Errorf("subsumes(%q, %q) = %v, want %v", c.a, c.b, got, c.want)
+		}
+	}
+}
+
+func TestCheckNonTerminating(t *testing.T) {
+	cases := []struct {
+		rule      string
+		wantProbs int
+	}{
+		{"(Add x y) -> (Add x y)", 1},
+		{"(Add x y) -> (Add y x)", 0}, // different arg order: not the same shape token-for-token
+		{"(Add x y) -> (Sub x y)", 0},
+		{"(Add x y) -> (Add x (Const [1]))", 0},
+		{"(Add (Const [1]) y) -> (Foo y)", 0},
+		// A cond doesn't save a same-shape rule: if it holds once, it
+		// holds again on the unchanged result, so this is still flagged.
+		{"(Add x y) && isPowerOfTwo(x) -> (Add x y)", 1},
+		// The commutative-swap variant of a guarded canonicalization rule
+		// (see parseRuleFileExpanded/expandCommutative): expandCommutative
+		// swaps the LHS but leaves the RHS as written, so this is a real
+		// self-reproducing rule in the generated code and must be flagged.
+		{"(Add y x) && shouldSwap(x, y) -> (Add y x)", 1},
+	}
+	for _, c := range cases {
+		rules := []ruleInfo{{line: 1, text: c.rule}}
+		got := checkNonTerminating("f.rules", "Add", rules)
+		if len(got) != c.wantProbs {
+			t.Errorf("checkNonTerminating(%q) = %v, want %d problem(s)", c.rule, got, c.wantProbs)
+		}
+	}
+}
+
+func TestCheckUnboundVars(t *testing.T) {
+	cases := []struct {
+		rule      string
+		wantProbs int
+	}{
+		{"(Add x y) -> (Sub x y)", 0},
+		{"(Add x y) -> (Sub x z)", 1},
+		{"(Add x y) && x > 0 -> (Sub x y)", 0},
+		{"(Add x y) && z > 0 -> (Sub x y)", 1},
+		{"(Mul <t:is64BitInt> x [c:isPowerOfTwo]) -> (Lsh x [log2(c)])", 0},
+		{"(Mul <t:is64BitInt> x [c:isPowerOfTwo]) -> (Lsh x [log2(d)])", 1},
+		{"(Add x y) -> (Foo [{x}])", 0},
+		{"(Add x y) -> (Foo [{z}])", 1},            // braced code is still checked even when it's one bare identifier
+		{"(Add x y) -> (Foo [x:isPowerOfTwo])", 0}, // name:pred: only the name is checked, not the predicate
+		{"(Add x y) -> (Foo [z:isPowerOfTwo])", 1},
+		{"(Add x y) -> (Foo [{v.AuxInt}])", 0},     // v is predefined as the matched value
+		{"(Add x y) -> (Sub <typ.UInt64> x y)", 0}, // dotted selector: typ is a package reference, not a pattern variable
+	}
+	for _, c := range cases {
+		r := ruleInfo{line: 1, text: c.rule}
+		got := checkUnboundVars("f.rules", r)
+		if len(got) != c.wantProbs {
+			t.Errorf("checkUnboundVars(%q) = %v, want %d problem(s)", c.rule, got, c.wantProbs)
+		}
+	}
+}
+
+// TestVerifyScopesCommutativeOps ensures verify doesn't leak a rule
+// file's commutative.txt/directive-derived opcodes into the
+// package-level commutativeOps once it returns, since verify may run
+// more than once in the same process.
+func TestVerifyScopesCommutativeOps(t *testing.T) {
+	before := map[string]bool{}
+	for op, v := range commutativeOps {
+		before[op] = v
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.rules")
+	content := "// commutative Foo\n(Foo a b) -> (Bar a b)\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	verify(path, "")
+
+	if commutativeOps["Foo"] {
+		t.Errorf("commutativeOps[%q] leaked into package state after verify returned", "Foo")
+	}
+	if !reflect.DeepEqual(commutativeOps, before) {
+		t.Errorf("verify left commutativeOps as %v, want it restored to %v", commutativeOps, before)
+	}
+}
+
+// ssaStub is a minimal stand-in for the real ssa package's Value type,
+// just enough for a generated rewrite function to compile against.
+const ssaStub = `package ssa
+
+type Op int
+
+const (
+	OpLsh Op = iota
+	OpConst
+	OpFoo2
+	OpFoo4
+	OpAdd
+	OpAdd2
+)
+
+type Value struct {
+	Op         Op
+	Args       []*Value
+	Aux        interface{}
+	AuxInt     int64
+	Type       interface{}
+	argstorage [2]*Value
+}
+
+func (v *Value) AddArg(a *Value) { v.Args = append(v.Args, a) }
+`
+
+// TestGenerateRulesCompiles is a compile round-trip test: it runs a
+// rule file all the way through generateRules, the same path main()
+// takes, and feeds the result to the real go compiler alongside a
+// stub ssa package. This is what caught the "label end0 defined and
+// not used" bug in a rule whose top-level arg an enclosing decision
+// tree fully discriminates and which has no further restriction of
+// its own (see emitRule).
+func TestGenerateRulesCompiles(t *testing.T) {
+	cases := []struct {
+		name  string
+		rules string
+	}{
+		{"simple", "(Add x y) -> (Add2 x y)\n"},
+		{
+			// a decision tree on arg 0's opcode: the two Const rules
+			// share one "case OpConst:" node, and the first adds no
+			// further restriction of its own, so genMatch never
+			// references fail for it. (Lsh x y) handles any other arg 0.
+			"hoisted-no-further-check",
+			"(Lsh (Const [c]) y) -> (Foo2 y [c])\n(Lsh (Const x) y) -> (Foo2 x y)\n(Lsh x y) -> (Foo4 x y)\n",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			rulefile := filepath.Join(dir, "test.rules")
+			if err := ioutil.WriteFile(rulefile, []byte(c.rules), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := generateRules(rulefile, "rewriteTest", "test.rules rewriteTest")
+			if err != nil {
+				t.Fatalf("generateRules: %v", err)
+			}
+
+			pkgDir := filepath.Join(dir, "pkg")
+			if err := os.Mkdir(pkgDir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(pkgDir, "stub.go"), []byte(ssaStub), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(pkgDir, "rewrite.go"), got, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			cmd := exec.Command("go", "build", ".")
+			cmd.Dir = pkgDir
+			cmd.Env = append(os.Environ(), "GO111MODULE=off")
+			if out, err := cmd.CombinedOutput(); err != nil {
+				t.Fatalf("generated code doesn't compile: %v\n%s\n--- source ---\n%s", err, out, got)
+			}
+		})
+	}
+}